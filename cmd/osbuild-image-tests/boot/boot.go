@@ -0,0 +1,282 @@
+// Package boot boots the images produced by osbuild-image-tests and runs a
+// basic smoke test against them, so that a testcase's "boot" section is
+// backed by more than just a declaration of intent.
+package boot
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Config mirrors the "boot" section of a testcase and selects which
+// backend Run should boot the produced artifact with.
+type Config struct {
+	Type string
+}
+
+// Options carries the command line flags that influence how local boots
+// are treated; it mirrors the existing -disable-local-boot/-fail-local-boot
+// flags of cmd/osbuild-image-tests.
+type Options struct {
+	DisableLocalBoot bool
+	FailLocalBoot    bool
+}
+
+// Run boots the image at imagePath according to cfg and runs a smoke test
+// against it. It is meant to be called as a subtest of testImage, e.g.
+// t.Run("boot", func(t *testing.T) { boot.Run(t, *testcase.Boot, imagePath, opts) }).
+func Run(t *testing.T, cfg Config, imagePath string, opts Options) {
+	switch cfg.Type {
+	case "qemu", "nested":
+		runLocalBoot(t, imagePath, opts)
+	case "aws", "gcp", "azure", "openstack":
+		runCloudBoot(t, cfg, imagePath)
+	default:
+		t.Fatalf("unknown boot type %q", cfg.Type)
+	}
+}
+
+func runLocalBoot(t *testing.T, imagePath string, opts Options) {
+	if opts.DisableLocalBoot {
+		t.Skip("local boot is disabled via -disable-local-boot")
+	}
+	if opts.FailLocalBoot {
+		t.Fatal("local boot is expected to fail (missing qemu/ssh setup); pass -fail-local-boot=false once the host is set up to boot images locally")
+	}
+
+	creds, err := LoadCredentials()
+	require.NoError(t, err, "cannot load boot credentials")
+
+	inst, err := bootQEMU(imagePath, creds)
+	require.NoError(t, err, "cannot boot %s under qemu", imagePath)
+	defer inst.Stop()
+
+	smokeTest(t, inst)
+	if t.Failed() {
+		t.Logf("qemu console log:\n%s", inst.log.String())
+	}
+}
+
+func runCloudBoot(t *testing.T, cfg Config, imagePath string) {
+	creds, err := LoadCredentials()
+	require.NoError(t, err, "cannot load boot credentials")
+
+	if _, ok := creds[cfg.Type+"_access_key"]; !ok {
+		t.Skipf("no credentials configured for the %q boot backend, skipping", cfg.Type)
+	}
+
+	// Uploading imagePath and driving an actual instance in a cloud
+	// account needs that cloud's SDK, which this checkout doesn't vendor
+	// yet, so there is nothing more to do here than report that clearly.
+	t.Skipf("booting images in %q is not implemented in this checkout yet", cfg.Type)
+}
+
+// syncBuffer is a bytes.Buffer safe to write to concurrently, so it can be
+// used as an *exec.Cmd's Stdout/Stderr while the test goroutine reads it
+// back to report the guest's console log on failure.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// instance represents a booted local qemu guest, reachable over SSH via a
+// forwarded port on localhost.
+type instance struct {
+	cmd   *exec.Cmd
+	port  int
+	creds map[string]string
+	log   *syncBuffer
+}
+
+// Stop terminates the guest.
+func (i *instance) Stop() {
+	if i.cmd.Process != nil {
+		_ = i.cmd.Process.Kill()
+	}
+	_ = i.cmd.Wait()
+}
+
+// ssh runs command on the instance via the system ssh client and returns
+// its combined output.
+func (i *instance) ssh(command string) (string, error) {
+	user := i.creds["ssh_user"]
+	if user == "" {
+		user = "redhat"
+	}
+
+	args := []string{
+		"-p", strconv.Itoa(i.port),
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "ConnectTimeout=5",
+	}
+	if key := i.creds["ssh_key"]; key != "" {
+		args = append(args, "-i", key)
+	}
+	args = append(args, fmt.Sprintf("%s@localhost", user), command)
+
+	out, err := exec.Command("ssh", args...).CombinedOutput()
+	return string(out), err
+}
+
+// freePort asks the kernel for a currently unused TCP port on localhost, so
+// that concurrently booted qemu instances (cmd/osbuild-image-tests' -n
+// flag) don't collide trying to forward SSH to the same host port.
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, fmt.Errorf("cannot allocate a free port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// bootQEMU starts imagePath under qemu with a hostfwd rule so SSH is
+// reachable on localhost, and waits for the guest to come up.
+func bootQEMU(imagePath string, creds map[string]string) (*instance, error) {
+	sshPort, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(
+		"qemu-system-x86_64",
+		"-m", "2048",
+		"-drive", fmt.Sprintf("file=%s,if=virtio,format=raw", imagePath),
+		"-net", "nic,model=virtio",
+		"-net", fmt.Sprintf("user,hostfwd=tcp::%d-:22", sshPort),
+		"-nographic",
+		"-snapshot",
+	)
+	log := &syncBuffer{}
+	cmd.Stdout = log
+	cmd.Stderr = log
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("cannot start qemu: %v", err)
+	}
+
+	inst := &instance{cmd: cmd, port: sshPort, creds: creds, log: log}
+	if err := waitForSSH(inst, 5*time.Minute); err != nil {
+		inst.Stop()
+		return nil, fmt.Errorf("%v\nqemu console log:\n%s", err, log.String())
+	}
+	return inst, nil
+}
+
+// waitForSSH polls the guest until it answers over SSH or timeout elapses.
+func waitForSSH(inst *instance, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	var lastErr error
+	for time.Now().Before(deadline) {
+		if _, err := inst.ssh("true"); err == nil {
+			return nil
+		} else {
+			lastErr = err
+		}
+		time.Sleep(5 * time.Second)
+	}
+	return fmt.Errorf("guest never became reachable over ssh: %v", lastErr)
+}
+
+// smokeTest runs a handful of sanity commands over SSH and fails the test
+// if any of them report a problem, printing their output on failure.
+func smokeTest(t *testing.T, inst *instance) {
+	checks := []struct {
+		name string
+		cmd  string
+	}{
+		{"uname", "uname -a"},
+		{"system is running", "systemctl is-system-running --wait"},
+		{"cloud-init finished", "cloud-init status --wait"},
+	}
+
+	for _, c := range checks {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			out, err := inst.ssh(c.cmd)
+			if err != nil {
+				t.Fatalf("%s: %v\noutput:\n%s", c.cmd, err, out)
+			}
+		})
+	}
+}
+
+// LoadCredentials loads the credentials used both for local qemu boots (an
+// SSH user/key) and for the cloud backends (account credentials). It looks
+// at the environment first (variables prefixed with OSBUILD_TEST_, e.g.
+// OSBUILD_TEST_AWS_ACCESS_KEY) and falls back to the flat key: value pairs
+// in ~/.config/osbuild-tests.yaml.
+func LoadCredentials() (map[string]string, error) {
+	creds := map[string]string{}
+
+	if home, err := os.UserHomeDir(); err == nil {
+		path := filepath.Join(home, ".config", "osbuild-tests.yaml")
+		if data, err := os.ReadFile(path); err == nil {
+			fileCreds, err := parseFlatYAML(data)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse %s: %v", path, err)
+			}
+			for k, v := range fileCreds {
+				creds[k] = v
+			}
+		}
+	}
+
+	const envPrefix = "OSBUILD_TEST_"
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, envPrefix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(kv, envPrefix), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		creds[strings.ToLower(parts[0])] = parts[1]
+	}
+
+	return creds, nil
+}
+
+// parseFlatYAML parses the restricted subset of YAML this package needs: a
+// flat mapping of "key: value" pairs, one per line, with "#" comments and
+// blank lines ignored.
+func parseFlatYAML(data []byte) (map[string]string, error) {
+	result := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid line %q", line)
+		}
+		result[strings.TrimSpace(parts[0])] = strings.Trim(strings.TrimSpace(parts[1]), `"'`)
+	}
+	return result, scanner.Err()
+}
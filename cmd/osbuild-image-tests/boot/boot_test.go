@@ -0,0 +1,31 @@
+package boot
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFlatYAML(t *testing.T) {
+	data := []byte(`
+# a comment
+ssh_user: redhat
+ssh_key: "/home/redhat/.ssh/id_rsa"
+
+aws_access_key: 'AKIA...'
+`)
+
+	creds, err := parseFlatYAML(data)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"ssh_user":       "redhat",
+		"ssh_key":        "/home/redhat/.ssh/id_rsa",
+		"aws_access_key": "AKIA...",
+	}, creds)
+}
+
+func TestParseFlatYAMLInvalidLine(t *testing.T) {
+	_, err := parseFlatYAML([]byte("not a valid mapping line"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,345 @@
+// Package container validates the OCI/Docker-archive artifacts osbuild can
+// produce: that the layout is well-formed, and, where the tooling is
+// available, that it survives a round-trip through a throwaway local
+// registry and carries the signature a testcase expects.
+package container
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Config mirrors the "container-image" section of a testcase: the extra
+// assertions Test should check on top of general OCI layout validity.
+type Config struct {
+	Layers     int               `json:"layers,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Entrypoint []string          `json:"entrypoint,omitempty"`
+	Signature  *Signature        `json:"signature,omitempty"`
+}
+
+// Signature declares that the image is expected to carry a cosign
+// signature, verifiable with Key against Identity.
+type Signature struct {
+	Key      string `json:"key"`
+	Identity string `json:"identity"`
+}
+
+type ociIndex struct {
+	Manifests []struct {
+		MediaType string `json:"mediaType"`
+		Digest    string `json:"digest"`
+	} `json:"manifests"`
+}
+
+type ociManifest struct {
+	Config struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+	Layers []struct {
+		Digest string `json:"digest"`
+	} `json:"layers"`
+}
+
+type ociImageConfig struct {
+	Config struct {
+		Labels     map[string]string `json:"Labels"`
+		Entrypoint []string          `json:"Entrypoint"`
+	} `json:"config"`
+}
+
+// Test validates imagePath as an OCI image against cfg, and, when skopeo
+// and podman are available, additionally pushes it to a throwaway local
+// registry, re-pulls it and checks the resulting manifest digest is
+// stable. It is meant to be called in place of the usual image-info
+// subtest, for exports whose last stage is org.osbuild.oci-archive or
+// org.osbuild.skopeo.
+func Test(t *testing.T, imagePath string, cfg Config) {
+	manifest, imgConfig, err := ValidateLayout(imagePath)
+	require.NoError(t, err, "invalid OCI layout")
+
+	if cfg.Layers > 0 && len(manifest.Layers) != cfg.Layers {
+		t.Errorf("expected %d layers, got %d", cfg.Layers, len(manifest.Layers))
+	}
+	for k, v := range cfg.Labels {
+		if got := imgConfig.Config.Labels[k]; got != v {
+			t.Errorf("label %q: expected %q, got %q", k, v, got)
+		}
+	}
+	if cfg.Entrypoint != nil {
+		require.Equal(t, cfg.Entrypoint, imgConfig.Config.Entrypoint)
+	}
+
+	t.Run("registry round-trip", func(t *testing.T) {
+		testRegistryRoundTrip(t, imagePath)
+	})
+
+	if cfg.Signature != nil {
+		t.Run("signature", func(t *testing.T) {
+			testSignature(t, imagePath, *cfg.Signature)
+		})
+	}
+}
+
+// ValidateLayout checks that imagePath (a directory or a tar archive, as
+// produced by org.osbuild.oci-archive) is a well-formed OCI image: the
+// index references a manifest that exists as a blob, and every blob's
+// content actually hashes to the digest its filename claims.
+func ValidateLayout(imagePath string) (*ociManifest, *ociImageConfig, error) {
+	idxFile, err := openEntry(imagePath, "index.json")
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot open index.json: %v", err)
+	}
+	defer idxFile.Close()
+
+	var idx ociIndex
+	if err := json.NewDecoder(idxFile).Decode(&idx); err != nil {
+		return nil, nil, fmt.Errorf("cannot decode index.json: %v", err)
+	}
+	if len(idx.Manifests) == 0 {
+		return nil, nil, fmt.Errorf("index.json lists no manifests")
+	}
+
+	manifestBytes, err := readBlob(imagePath, idx.Manifests[0].Digest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var manifest ociManifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, nil, fmt.Errorf("cannot decode manifest %s: %v", idx.Manifests[0].Digest, err)
+	}
+
+	configBytes, err := readBlob(imagePath, manifest.Config.Digest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var imgConfig ociImageConfig
+	if err := json.Unmarshal(configBytes, &imgConfig); err != nil {
+		return nil, nil, fmt.Errorf("cannot decode image config %s: %v", manifest.Config.Digest, err)
+	}
+
+	for _, l := range manifest.Layers {
+		if _, err := readBlob(imagePath, l.Digest); err != nil {
+			return nil, nil, fmt.Errorf("layer %s: %v", l.Digest, err)
+		}
+	}
+
+	return &manifest, &imgConfig, nil
+}
+
+// readBlob reads the blob named by digest (e.g. "sha256:abcd...") out of
+// imagePath and verifies its content actually hashes to that digest.
+func readBlob(imagePath, digest string) ([]byte, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[0] != "sha256" {
+		return nil, fmt.Errorf("unsupported digest algorithm in %q", digest)
+	}
+
+	r, err := openEntry(imagePath, filepath.Join("blobs", "sha256", parts[1]))
+	if err != nil {
+		return nil, fmt.Errorf("cannot open blob %s: %v", digest, err)
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read blob %s: %v", digest, err)
+	}
+
+	sum := sha256.Sum256(data)
+	if got := "sha256:" + hex.EncodeToString(sum[:]); got != digest {
+		return nil, fmt.Errorf("blob digest mismatch: expected %s, got %s", digest, got)
+	}
+
+	return data, nil
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// openEntry opens the OCI layout entry named name (e.g. "index.json" or
+// "blobs/sha256/<digest>") out of imagePath, whether that is a plain
+// directory or a tar archive.
+func openEntry(imagePath, name string) (io.ReadCloser, error) {
+	if isDir(imagePath) {
+		return os.Open(filepath.Join(imagePath, name))
+	}
+
+	f, err := os.Open(imagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			f.Close()
+			return nil, fmt.Errorf("entry %q not found in archive", name)
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if strings.TrimPrefix(hdr.Name, "./") == name {
+			return readCloser{tr, f}, nil
+		}
+	}
+}
+
+// readCloser pairs a reader scoped to one tar entry with the underlying
+// file, so that closing it closes the archive too.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// skopeoRef returns the skopeo/cosign transport reference for imagePath.
+func skopeoRef(imagePath string) string {
+	if isDir(imagePath) {
+		return "oci:" + imagePath
+	}
+	return "oci-archive:" + imagePath
+}
+
+// testRegistryRoundTrip pushes imagePath to a throwaway local registry,
+// then pulls it back down to a second local OCI layout and checks that
+// the pushed and re-pulled manifest digests both match the original
+// local one, proving the export survives a real push/pull cycle rather
+// than just comparing a single pushed ref against itself. It skips
+// itself when podman or skopeo aren't available, since those are needed
+// to actually run a registry.
+func testRegistryRoundTrip(t *testing.T, imagePath string) {
+	for _, bin := range []string{"podman", "skopeo"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skipf("%s not available, skipping registry round-trip", bin)
+		}
+	}
+
+	localDigest, err := localManifestDigest(imagePath)
+	require.NoError(t, err, "cannot read local manifest digest")
+
+	const registryImage = "docker.io/library/registry:2"
+
+	registryPort, err := freePort()
+	require.NoError(t, err, "cannot allocate a port for the throwaway registry")
+
+	containerName := "osbuild-image-tests-registry-" + filepath.Base(imagePath)
+
+	require.NoError(t, runCmd(exec.Command(
+		"podman", "run", "-d", "--rm",
+		"--name", containerName,
+		"-p", fmt.Sprintf("%d:5000", registryPort),
+		registryImage,
+	)), "cannot start throwaway registry")
+	defer func() {
+		_ = runCmd(exec.Command("podman", "rm", "-f", containerName))
+	}()
+
+	dest := fmt.Sprintf("docker://localhost:%s/%s:latest", strconv.Itoa(registryPort), filepath.Base(imagePath))
+
+	require.NoError(t, runCmd(exec.Command(
+		"skopeo", "copy", "--dest-tls-verify=false", skopeoRef(imagePath), dest,
+	)), "cannot push image to the throwaway registry")
+
+	pushedDigest, err := inspectDigest(dest)
+	require.NoError(t, err)
+	require.Equal(t, localDigest, pushedDigest, "manifest digest changed across the push")
+
+	pullDir := filepath.Join(t.TempDir(), "pulled")
+	require.NoError(t, runCmd(exec.Command(
+		"skopeo", "copy", "--src-tls-verify=false", dest, "oci:"+pullDir,
+	)), "cannot re-pull image from the throwaway registry")
+
+	pulledDigest, err := localManifestDigest(pullDir)
+	require.NoError(t, err, "cannot read re-pulled manifest digest")
+	require.Equal(t, localDigest, pulledDigest, "manifest digest changed across the re-pull")
+}
+
+// localManifestDigest returns the digest of imagePath's first manifest, as
+// recorded in its own index.json, without going through any registry.
+func localManifestDigest(imagePath string) (string, error) {
+	idxFile, err := openEntry(imagePath, "index.json")
+	if err != nil {
+		return "", fmt.Errorf("cannot open index.json: %v", err)
+	}
+	defer idxFile.Close()
+
+	var idx ociIndex
+	if err := json.NewDecoder(idxFile).Decode(&idx); err != nil {
+		return "", fmt.Errorf("cannot decode index.json: %v", err)
+	}
+	if len(idx.Manifests) == 0 {
+		return "", fmt.Errorf("index.json lists no manifests")
+	}
+	return idx.Manifests[0].Digest, nil
+}
+
+// freePort asks the kernel for a currently unused TCP port on localhost, so
+// that concurrently run container-export testcases (cmd/osbuild-image-tests'
+// -n flag) don't collide trying to publish their throwaway registry on the
+// same host port.
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, fmt.Errorf("cannot allocate a free port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+func inspectDigest(ref string) (string, error) {
+	out, err := exec.Command("skopeo", "inspect", "--tls-verify=false", ref).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("skopeo inspect failed: %v: %s", err, out)
+	}
+
+	var info struct {
+		Digest string `json:"Digest"`
+	}
+	if err := json.Unmarshal(out, &info); err != nil {
+		return "", fmt.Errorf("cannot decode skopeo inspect output: %v", err)
+	}
+	return info.Digest, nil
+}
+
+// testSignature verifies imagePath carries a cosign signature matching
+// sig. It skips itself when cosign isn't available.
+func testSignature(t *testing.T, imagePath string, sig Signature) {
+	if _, err := exec.LookPath("cosign"); err != nil {
+		t.Skip("cosign not available, skipping signature verification")
+	}
+
+	require.NoError(t, runCmd(exec.Command(
+		"cosign", "verify",
+		"--key", sig.Key,
+		"--certificate-identity", sig.Identity,
+		skopeoRef(imagePath),
+	)), "signature verification failed")
+}
+
+func runCmd(cmd *exec.Cmd) error {
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v: %s", strings.Join(cmd.Args, " "), err, out)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package container
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeBlob writes data under dir/blobs/sha256/<digest> and returns its
+// "sha256:<digest>" reference.
+func writeBlob(t *testing.T, dir string, data []byte) string {
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+
+	blobDir := filepath.Join(dir, "blobs", "sha256")
+	require.NoError(t, os.MkdirAll(blobDir, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(blobDir, digest), data, 0644))
+
+	return "sha256:" + digest
+}
+
+func TestValidateLayoutDirectory(t *testing.T) {
+	dir := t.TempDir()
+
+	configDigest := writeBlob(t, dir, []byte(`{"config":{"Labels":{"name":"test"},"Entrypoint":["/bin/sh"]}}`))
+	layerDigest := writeBlob(t, dir, []byte("layer contents"))
+
+	manifest, err := json.Marshal(map[string]interface{}{
+		"config": map[string]string{"digest": configDigest},
+		"layers": []map[string]string{{"digest": layerDigest}},
+	})
+	require.NoError(t, err)
+	manifestDigest := writeBlob(t, dir, manifest)
+
+	index, err := json.Marshal(map[string]interface{}{
+		"manifests": []map[string]string{{"digest": manifestDigest}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "index.json"), index, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644))
+
+	parsedManifest, imgConfig, err := ValidateLayout(dir)
+	require.NoError(t, err)
+	require.Len(t, parsedManifest.Layers, 1)
+	require.Equal(t, "test", imgConfig.Config.Labels["name"])
+	require.Equal(t, []string{"/bin/sh"}, imgConfig.Config.Entrypoint)
+}
+
+func TestLocalManifestDigest(t *testing.T) {
+	dir := t.TempDir()
+
+	manifest, err := json.Marshal(map[string]interface{}{"config": map[string]string{}})
+	require.NoError(t, err)
+	manifestDigest := writeBlob(t, dir, manifest)
+
+	index, err := json.Marshal(map[string]interface{}{
+		"manifests": []map[string]string{{"digest": manifestDigest}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "index.json"), index, 0644))
+
+	digest, err := localManifestDigest(dir)
+	require.NoError(t, err)
+	require.Equal(t, manifestDigest, digest)
+}
+
+func TestValidateLayoutCorruptBlob(t *testing.T) {
+	dir := t.TempDir()
+
+	configDigest := writeBlob(t, dir, []byte(`{"config":{}}`))
+	manifest, err := json.Marshal(map[string]interface{}{
+		"config": map[string]string{"digest": configDigest},
+	})
+	require.NoError(t, err)
+	manifestDigest := writeBlob(t, dir, manifest)
+
+	// corrupt the manifest blob after the fact, so its content no longer
+	// matches the digest index.json references
+	require.NoError(t, ioutil.WriteFile(
+		filepath.Join(dir, "blobs", "sha256", manifestDigest[len("sha256:"):]),
+		[]byte("corrupted"),
+		0644,
+	))
+
+	index, err := json.Marshal(map[string]interface{}{
+		"manifests": []map[string]string{{"digest": manifestDigest}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "index.json"), index, 0644))
+
+	_, _, err = ValidateLayout(dir)
+	require.Error(t, err)
+}
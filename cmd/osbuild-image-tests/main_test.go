@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"flag"
@@ -10,13 +11,32 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/osbuild/osbuild/cmd/osbuild-image-tests/boot"
 	"github.com/osbuild/osbuild/cmd/osbuild-image-tests/constants"
+	"github.com/osbuild/osbuild/cmd/osbuild-image-tests/container"
+	"github.com/osbuild/osbuild/cmd/osbuild-image-tests/report"
+)
+
+// backend identifies an execution environment a testcase can be run
+// against, as selected via the -workers flag.
+type backend string
+
+const (
+	backendLocal backend = "local"
+	backendQEMU  backend = "qemu"
+	backendAWS   backend = "aws"
+	backendGCP   backend = "gcp"
+	backendAzure backend = "azure"
 )
 
 type testcaseStruct struct {
@@ -25,11 +45,18 @@ type testcaseStruct struct {
 		Arch     string
 		Filename string
 	} `json:"compose-request"`
-	Manifest  json.RawMessage
-	ImageInfo json.RawMessage `json:"image-info"`
-	Boot      *struct {
-		Type string
-	}
+	Manifest       json.RawMessage
+	ImageInfo      json.RawMessage `json:"image-info"`
+	Boot           *boot.Config
+	ContainerImage *container.Config `json:"container-image"`
+	// Exports, when given, asserts against several artifacts produced by
+	// the same manifest instead of the single one named by
+	// ComposeRequest.Filename/ImageInfo above.
+	Exports []struct {
+		Pipeline  string
+		Filename  string
+		ImageInfo json.RawMessage `json:"image-info"`
+	} `json:"exports,omitempty"`
 }
 
 type strArrayFlag []string
@@ -47,16 +74,116 @@ var disableLocalBoot bool
 var failLocalBoot bool
 var skipSELinuxCtxCheck bool
 var skipTmpfilesdPaths strArrayFlag
+var workerCount int
+var includePattern string
+var excludePattern string
+var backendsFlag string
+var reportPath string
+
+// testReport collects the -report output; nil when -report wasn't given.
+var testReport *report.Report
 
 func init() {
 	flag.BoolVar(&disableLocalBoot, "disable-local-boot", false, "when this flag is given, no images are booted locally using qemu (this does not affect testing in clouds)")
 	flag.BoolVar(&failLocalBoot, "fail-local-boot", true, "when this flag is on (default), local boot will fail. Usually indicates missing cloud credentials")
 	flag.BoolVar(&skipSELinuxCtxCheck, "skip-selinux-ctx-check", false, "when this flag is on, the 'selinux/context-mismatch' part is removed from the image-info report before it is checked.")
 	flag.Var(&skipTmpfilesdPaths, "skip-tmpfilesd-path", "when this flag is given, the provided path is removed from the 'tmpfiles.d' section of the image-info report before it is checked.")
+	flag.IntVar(&workerCount, "n", 1, "run up to n testcases concurrently, mirroring go test's own -parallel flag")
+	flag.StringVar(&includePattern, "include", "", "only run testcases whose base name matches this regexp")
+	flag.StringVar(&excludePattern, "exclude", "", "skip testcases whose base name matches this regexp")
+	flag.StringVar(&backendsFlag, "workers", string(backendLocal), "comma-separated list of execution backends to run every testcase against (local, qemu, aws, gcp, azure)")
+	flag.StringVar(&reportPath, "report", "", "write a machine-readable JSON test report to this path")
+}
+
+// filterCases returns the subset of cases whose base name matches include
+// (if non-empty) and does not match exclude (if non-empty).
+func filterCases(cases []string, include, exclude string) ([]string, error) {
+	var includeRe, excludeRe *regexp.Regexp
+	var err error
+	if include != "" {
+		if includeRe, err = regexp.Compile(include); err != nil {
+			return nil, fmt.Errorf("invalid -include pattern: %v", err)
+		}
+	}
+	if exclude != "" {
+		if excludeRe, err = regexp.Compile(exclude); err != nil {
+			return nil, fmt.Errorf("invalid -exclude pattern: %v", err)
+		}
+	}
+
+	var filtered []string
+	for _, p := range cases {
+		name := path.Base(p)
+		if includeRe != nil && !includeRe.MatchString(name) {
+			continue
+		}
+		if excludeRe != nil && excludeRe.MatchString(name) {
+			continue
+		}
+		filtered = append(filtered, p)
+	}
+	return filtered, nil
+}
+
+// parseBackends splits a comma-separated -workers value into the list of
+// execution backends each testcase should be run against.
+func parseBackends(s string) ([]backend, error) {
+	var backends []backend
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		switch backend(name) {
+		case backendLocal, backendQEMU, backendAWS, backendGCP, backendAzure:
+			backends = append(backends, backend(name))
+		default:
+			return nil, fmt.Errorf("unknown execution backend %q", name)
+		}
+	}
+	return backends, nil
+}
+
+func TestFilterCases(t *testing.T) {
+	cases := []string{"/dir/fedora-qcow2", "/dir/fedora-ami", "/dir/rhel-qcow2"}
+
+	filtered, err := filterCases(cases, "", "")
+	require.NoError(t, err)
+	assert.Equal(t, cases, filtered)
+
+	filtered, err = filterCases(cases, "qcow2", "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/dir/fedora-qcow2", "/dir/rhel-qcow2"}, filtered)
+
+	filtered, err = filterCases(cases, "", "fedora")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/dir/rhel-qcow2"}, filtered)
+
+	filtered, err = filterCases(cases, "fedora", "ami")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/dir/fedora-qcow2"}, filtered)
+
+	_, err = filterCases(cases, "[", "")
+	assert.Error(t, err)
+
+	_, err = filterCases(cases, "", "[")
+	assert.Error(t, err)
+}
+
+func TestParseBackends(t *testing.T) {
+	backends, err := parseBackends("local")
+	require.NoError(t, err)
+	assert.Equal(t, []backend{backendLocal}, backends)
+
+	backends, err = parseBackends("local, qemu,aws")
+	require.NoError(t, err)
+	assert.Equal(t, []backend{backendLocal, backendQEMU, backendAWS}, backends)
+
+	_, err = parseBackends("local,bogus")
+	assert.Error(t, err)
 }
 
 // runOsbuild runs osbuild with the specified manifest and output-directory.
-func runOsbuild(manifest []byte, store, outputDirectory string, exports []string) error {
+// It returns osbuild's raw, unparsed stdout alongside any error, so that
+// callers can extract timing information from it for the -report output.
+func runOsbuild(manifest []byte, store, outputDirectory string, exports []string) ([]byte, error) {
 	cmd := constants.GetOsbuildCommand(store, outputDirectory, exports)
 
 	cmd.Stdin = bytes.NewReader(manifest)
@@ -80,10 +207,68 @@ func runOsbuild(manifest []byte, store, outputDirectory string, exports []string
 		// stderr isn't structured, print it as is
 		fmt.Printf("stderr:\n%s", errBuffer.String())
 
-		return fmt.Errorf("running osbuild failed: %v", err)
+		return outBuffer.Bytes(), fmt.Errorf("running osbuild failed: %v", err)
 	}
 
-	return nil
+	return outBuffer.Bytes(), nil
+}
+
+// monitorEvent is a tolerant view of a single line of osbuild's "--json"
+// monitor output: only the fields needed to attribute wall-clock time to a
+// pipeline are decoded, everything else is ignored.
+type monitorEvent struct {
+	Timestamp float64 `json:"timestamp"`
+	Context   struct {
+		Pipeline struct {
+			Name string `json:"name"`
+		} `json:"pipeline"`
+	} `json:"context"`
+}
+
+// pipelineDurations does a best-effort extraction of a per-pipeline
+// wall-clock duration out of osbuild's JSON monitor output, by tracking the
+// first and last timestamp seen for each pipeline name. It never fails:
+// lines it cannot make sense of are simply skipped, since this is only
+// meant to enrich the -report output, not to gate on it.
+func pipelineDurations(stdout []byte) map[string]time.Duration {
+	type span struct {
+		first, last float64
+	}
+	spans := map[string]*span{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(stdout))
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		var ev monitorEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			continue
+		}
+		name := ev.Context.Pipeline.Name
+		if name == "" {
+			continue
+		}
+		s, ok := spans[name]
+		if !ok {
+			spans[name] = &span{first: ev.Timestamp, last: ev.Timestamp}
+			continue
+		}
+		if ev.Timestamp < s.first {
+			s.first = ev.Timestamp
+		}
+		if ev.Timestamp > s.last {
+			s.last = ev.Timestamp
+		}
+	}
+
+	if len(spans) == 0 {
+		return nil
+	}
+
+	durations := make(map[string]time.Duration, len(spans))
+	for name, s := range spans {
+		durations[name] = time.Duration((s.last - s.first) * float64(time.Second))
+	}
+	return durations
 }
 
 // Delete the 'selinux/context-mismatch' part of the image-info report to
@@ -116,8 +301,9 @@ func deleteTmpfilesdPathFromImageInfoReport(imageInfoReport interface{}, path st
 }
 
 // testImageInfo runs image-info on image specified by imageImage and
-// compares the result with expected image info
-func testImageInfo(t *testing.T, imagePath string, rawImageInfoExpected []byte) {
+// compares the result with expected image info, returning the structured
+// diff between the two (empty when they match) for the -report output.
+func testImageInfo(t *testing.T, imagePath string, rawImageInfoExpected []byte) []report.Diff {
 	var imageInfoExpected interface{}
 	err := json.Unmarshal(rawImageInfoExpected, &imageInfoExpected)
 	require.NoErrorf(t, err, "cannot decode expected image info: %v", err)
@@ -149,50 +335,319 @@ func testImageInfo(t *testing.T, imagePath string, rawImageInfoExpected []byte)
 		deleteTmpfilesdPathFromImageInfoReport(imageInfoGot, path)
 	}
 
+	diff := report.DiffImageInfo(imageInfoExpected, imageInfoGot)
 	assert.Equal(t, imageInfoExpected, imageInfoGot)
+	return diff
 }
 
-// testImage performs a series of tests specified in the testcase
-// on an image
-func testImage(t *testing.T, testcase testcaseStruct, imagePath string) {
-	if testcase.ImageInfo != nil {
+// testImage performs a series of tests on an image, recording their
+// outcome into er when a -report was requested (er is nil otherwise).
+// bootCfg is nil when the artifact shouldn't be booted, e.g. for every
+// export of a testcase but its primary one.
+func testImage(t *testing.T, imageInfo json.RawMessage, bootCfg *boot.Config, imagePath string, er *report.ExportResult) {
+	if imageInfo != nil {
 		t.Run("image info", func(t *testing.T) {
-			testImageInfo(t, imagePath, testcase.ImageInfo)
+			diff := testImageInfo(t, imagePath, imageInfo)
+			if er != nil {
+				er.ImageInfoDiff = diff
+			}
 		})
 	}
+
+	if bootCfg != nil {
+		t.Run("boot", func(t *testing.T) {
+			// deferred, so that the outcome is also recorded when boot.Run
+			// ends the subtest early via t.Skip or t.Fatal
+			defer func() {
+				if er != nil {
+					if t.Failed() {
+						er.BootOutcome = "failed"
+					} else if t.Skipped() {
+						er.BootOutcome = "skipped"
+					} else {
+						er.BootOutcome = "passed"
+					}
+				}
+			}()
+			boot.Run(t, *bootCfg, imagePath, boot.Options{
+				DisableLocalBoot: disableLocalBoot,
+				FailLocalBoot:    failLocalBoot,
+			})
+		})
+	}
+}
+
+// exportStageTypes lists the stage types that turn a pipeline's tree into
+// an artifact worth exporting, as opposed to an intermediate tree pipeline
+// that only other pipelines consume.
+var exportStageTypes = map[string]bool{
+	"org.osbuild.qemu":          true,
+	"org.osbuild.tar":           true,
+	"org.osbuild.oci-archive":   true,
+	"org.osbuild.skopeo":        true,
+	"org.osbuild.ostree.commit": true,
+}
+
+// hasExportStage reports whether rawPipeline has a stage of one of the
+// exportStageTypes.
+func hasExportStage(rawPipeline json.RawMessage) bool {
+	var p struct {
+		Stages []struct {
+			Type string `json:"type"`
+		} `json:"stages"`
+	}
+	if err := json.Unmarshal(rawPipeline, &p); err != nil {
+		return false
+	}
+	for _, s := range p.Stages {
+		if exportStageTypes[s.Type] {
+			return true
+		}
+	}
+	return false
+}
+
+// pipelineReferences does a best-effort extraction of the names of the
+// pipelines rawPipeline's stages consume as inputs, by looking at each
+// "org.osbuild.pipeline"-style input's references, which are keyed (or,
+// depending on the input, listed) as "name:<pipeline>".
+func pipelineReferences(rawPipeline json.RawMessage) map[string]bool {
+	var p struct {
+		Stages []struct {
+			Inputs map[string]struct {
+				References json.RawMessage `json:"references"`
+			} `json:"inputs"`
+		} `json:"stages"`
+	}
+	refs := map[string]bool{}
+	if err := json.Unmarshal(rawPipeline, &p); err != nil {
+		return refs
+	}
+
+	addRef := func(ref string) {
+		if strings.HasPrefix(ref, "name:") {
+			refs[strings.TrimPrefix(ref, "name:")] = true
+		}
+	}
+
+	for _, stage := range p.Stages {
+		for _, input := range stage.Inputs {
+			if len(input.References) == 0 {
+				continue
+			}
+
+			var asList []string
+			if err := json.Unmarshal(input.References, &asList); err == nil {
+				for _, ref := range asList {
+					addRef(ref)
+				}
+				continue
+			}
+
+			var asMap map[string]json.RawMessage
+			if err := json.Unmarshal(input.References, &asMap); err == nil {
+				for ref := range asMap {
+					addRef(ref)
+				}
+			}
+		}
+	}
+	return refs
 }
 
-// guessPipelineToExport return a best-effort guess about which
-// pipeline should be exported when running osbuild for the testcase
-//
-// If this function detects that this is a version 1 manifest, it
-// always returns "assembler"
-//
-// For manifests version 2, the name of the last pipeline is returned.
-func guessPipelineToExport(rawManifest json.RawMessage) string {
+// pipelinesToExport returns the names of the pipelines that should be
+// exported when running osbuild for a testcase: the terminal pipelines
+// (the ones no other pipeline consumes as an input) that actually produce
+// an artifact, rather than just an intermediate tree. For a version 1
+// manifest, it falls back to the old single "assembler" export.
+func pipelinesToExport(rawManifest json.RawMessage) ([]string, error) {
 	const v1ManifestExportName = "assembler"
+
+	var v2Manifest struct {
+		Version   string            `json:"version"`
+		Pipelines []json.RawMessage `json:"pipelines"`
+	}
+	if err := json.Unmarshal(rawManifest, &v2Manifest); err != nil || v2Manifest.Version != "2" {
+		// if we cannot unmarshal, or this isn't a v2 manifest, assume
+		// it's a version 1 manifest
+		return []string{v1ManifestExportName}, nil
+	}
+
+	type pipeline struct {
+		name string
+		raw  json.RawMessage
+	}
+	var pipelines []pipeline
+	referenced := map[string]bool{}
+
+	for _, raw := range v2Manifest.Pipelines {
+		var p struct {
+			Name string `json:"name,omitempty"`
+		}
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return nil, fmt.Errorf("cannot decode pipeline: %v", err)
+		}
+		pipelines = append(pipelines, pipeline{name: p.Name, raw: raw})
+		for ref := range pipelineReferences(raw) {
+			referenced[ref] = true
+		}
+	}
+
+	var exports []string
+	for _, p := range pipelines {
+		if referenced[p.name] || !hasExportStage(p.raw) {
+			continue
+		}
+		exports = append(exports, p.name)
+	}
+
+	if len(exports) == 0 && len(pipelines) > 0 {
+		// nothing looked exportable: fall back to the old best-effort
+		// behaviour of exporting the last pipeline, rather than nothing.
+		exports = append(exports, pipelines[len(pipelines)-1].name)
+	}
+
+	return exports, nil
+}
+
+func TestHasExportStage(t *testing.T) {
+	assert.True(t, hasExportStage(json.RawMessage(`{"stages":[{"type":"org.osbuild.rpm"},{"type":"org.osbuild.qemu"}]}`)))
+	assert.False(t, hasExportStage(json.RawMessage(`{"stages":[{"type":"org.osbuild.rpm"}]}`)))
+	assert.False(t, hasExportStage(json.RawMessage(`not json`)))
+}
+
+func TestPipelineReferences(t *testing.T) {
+	withList := json.RawMessage(`{
+		"stages": [{"inputs": {"tree": {"references": ["name:build", "name:os"]}}}]
+	}`)
+	assert.Equal(t, map[string]bool{"build": true, "os": true}, pipelineReferences(withList))
+
+	withMap := json.RawMessage(`{
+		"stages": [{"inputs": {"tree": {"references": {"name:os": {}}}}}]
+	}`)
+	assert.Equal(t, map[string]bool{"os": true}, pipelineReferences(withMap))
+
+	assert.Empty(t, pipelineReferences(json.RawMessage(`{"stages":[]}`)))
+}
+
+func TestPipelinesToExport(t *testing.T) {
+	v1Manifest := json.RawMessage(`{"pipeline": {}}`)
+	exports, err := pipelinesToExport(v1Manifest)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"assembler"}, exports)
+
+	v2Manifest := json.RawMessage(`{
+		"version": "2",
+		"pipelines": [
+			{"name": "build", "stages": [{"type": "org.osbuild.rpm"}]},
+			{"name": "os", "stages": [
+				{"type": "org.osbuild.rpm", "inputs": {"tree": {"references": ["name:build"]}}}
+			]},
+			{"name": "image", "stages": [
+				{"type": "org.osbuild.qemu", "inputs": {"tree": {"references": ["name:os"]}}}
+			]}
+		]
+	}`)
+	exports, err = pipelinesToExport(v2Manifest)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"image"}, exports)
+
+	multiExport := json.RawMessage(`{
+		"version": "2",
+		"pipelines": [
+			{"name": "os", "stages": [{"type": "org.osbuild.rpm"}]},
+			{"name": "qcow2", "stages": [
+				{"type": "org.osbuild.qemu", "inputs": {"tree": {"references": ["name:os"]}}}
+			]},
+			{"name": "container", "stages": [
+				{"type": "org.osbuild.oci-archive", "inputs": {"tree": {"references": ["name:os"]}}}
+			]}
+		]
+	}`)
+	exports, err = pipelinesToExport(multiExport)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"qcow2", "container"}, exports)
+
+	noExportStages := json.RawMessage(`{
+		"version": "2",
+		"pipelines": [
+			{"name": "build", "stages": [{"type": "org.osbuild.rpm"}]},
+			{"name": "os", "stages": [
+				{"type": "org.osbuild.rpm", "inputs": {"tree": {"references": ["name:build"]}}}
+			]}
+		]
+	}`)
+	exports, err = pipelinesToExport(noExportStages)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"os"}, exports)
+}
+
+// lastStageType returns the type of the last stage in the named v2
+// manifest pipeline. The second return value is false for v1 manifests,
+// unparseable manifests, or when the pipeline can't be found.
+func lastStageType(rawManifest json.RawMessage, pipelineName string) (string, bool) {
 	var v2Manifest struct {
 		Version   string `json:"version"`
 		Pipelines []struct {
-			Name string `json:"name,omitempty"`
+			Name   string `json:"name,omitempty"`
+			Stages []struct {
+				Type string `json:"type"`
+			} `json:"stages,omitempty"`
 		} `json:"pipelines"`
 	}
-	err := json.Unmarshal(rawManifest, &v2Manifest)
-	if err != nil {
-		// if we cannot unmarshal, let's just assume that it's a version 1 manifest
-		return v1ManifestExportName
+	if err := json.Unmarshal(rawManifest, &v2Manifest); err != nil || v2Manifest.Version != "2" {
+		return "", false
 	}
 
-	if v2Manifest.Version == "2" {
-		return v2Manifest.Pipelines[len(v2Manifest.Pipelines)-1].Name
+	for _, p := range v2Manifest.Pipelines {
+		if p.Name == pipelineName && len(p.Stages) > 0 {
+			return p.Stages[len(p.Stages)-1].Type, true
+		}
 	}
+	return "", false
+}
 
-	return v1ManifestExportName
+// isContainerImageExport reports whether the named pipeline's export is an
+// OCI/Docker-archive image, i.e. its last stage packs a container rather
+// than producing a bootable disk image.
+func isContainerImageExport(rawManifest json.RawMessage, pipelineName string) bool {
+	stageType, ok := lastStageType(rawManifest, pipelineName)
+	return ok && (stageType == "org.osbuild.oci-archive" || stageType == "org.osbuild.skopeo")
+}
+
+// manifestVersion returns the manifest's "version" field, defaulting to
+// "1" since that's what the overwhelming majority of existing testcases
+// carry no explicit version for.
+func manifestVersion(rawManifest json.RawMessage) string {
+	var v struct {
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(rawManifest, &v); err != nil || v.Version == "" {
+		return "1"
+	}
+	return v.Version
 }
 
 // runTestcase builds the pipeline specified in the testcase and then it
-// tests the result
-func runTestcase(t *testing.T, testcase testcaseStruct, store string) {
+// tests the result. store is shared across concurrently running workers;
+// this is safe because osbuild is invoked with "--checkpoint build", so
+// concurrent builds only ever add to the store, never race on the same
+// checkpoint. name identifies the case in the -report output.
+func runTestcase(t *testing.T, testcase testcaseStruct, store, name string, b backend) {
+	if b != backendLocal {
+		t.Skipf("the %q execution backend is not implemented yet", b)
+	}
+
+	var c *report.Case
+	start := time.Now()
+	if testReport != nil {
+		c = &report.Case{Name: name, ManifestVersion: manifestVersion(testcase.Manifest)}
+		defer func() {
+			c.Duration = time.Since(start)
+			testReport.Add(c)
+		}()
+	}
+
 	_ = os.Mkdir("/var/lib/osbuild-tests", 0755)
 	outputDirectory, err := ioutil.TempDir("/var/lib/osbuild-tests", "osbuild-image-tests-*")
 	require.NoError(t, err, "error creating temporary output directory")
@@ -202,13 +657,88 @@ func runTestcase(t *testing.T, testcase testcaseStruct, store string) {
 		require.NoError(t, err, "error removing temporary output directory")
 	}()
 
-	exports := []string{guessPipelineToExport(testcase.Manifest)}
-	err = runOsbuild(testcase.Manifest, store, outputDirectory, exports)
+	// exportSpec names a single artifact that runTestcase should check:
+	// which pipeline produces it, what its filename is, and what image-info
+	// it's expected to match.
+	type exportSpec struct {
+		pipeline  string
+		filename  string
+		imageInfo json.RawMessage
+	}
+
+	var specs []exportSpec
+	if len(testcase.Exports) > 0 {
+		for _, e := range testcase.Exports {
+			specs = append(specs, exportSpec{pipeline: e.Pipeline, filename: e.Filename, imageInfo: e.ImageInfo})
+		}
+	} else {
+		exports, err := pipelinesToExport(testcase.Manifest)
+		require.NoError(t, err)
+		if len(exports) > 1 {
+			t.Fatalf("manifest produces %d exportable pipelines (%v) but this testcase has no \"exports\" section saying which filename/image-info each one corresponds to; add one explicit entry per pipeline", len(exports), exports)
+		}
+		for _, p := range exports {
+			specs = append(specs, exportSpec{pipeline: p, filename: testcase.ComposeRequest.Filename, imageInfo: testcase.ImageInfo})
+		}
+	}
+
+	exportNames := make([]string, len(specs))
+	for i, s := range specs {
+		exportNames[i] = s.pipeline
+	}
+	if c != nil {
+		c.ExportedPipelines = exportNames
+	}
+
+	stdout, err := runOsbuild(testcase.Manifest, store, outputDirectory, exportNames)
+	if c != nil {
+		c.PipelineDurations = pipelineDurations(stdout)
+		if err != nil {
+			c.Error = err.Error()
+		}
+	}
 	require.NoError(t, err)
 
-	for _, export := range exports {
-		imagePath := filepath.Join(outputDirectory, export, testcase.ComposeRequest.Filename)
-		testImage(t, testcase, imagePath)
+	for i, s := range specs {
+		s := s
+
+		var er *report.ExportResult
+		if c != nil {
+			er = &report.ExportResult{Pipeline: s.pipeline}
+		}
+
+		imagePath := filepath.Join(outputDirectory, s.pipeline, s.filename)
+
+		t.Run(s.pipeline, func(t *testing.T) {
+			// deferred, so that the error is also recorded when a check
+			// ends this subtest early via t.FailNow
+			defer func() {
+				if er != nil && t.Failed() {
+					er.Error = "export failed, see test output"
+				}
+			}()
+
+			if isContainerImageExport(testcase.Manifest, s.pipeline) {
+				var cfg container.Config
+				if testcase.ContainerImage != nil {
+					cfg = *testcase.ContainerImage
+				}
+				container.Test(t, imagePath, cfg)
+			} else {
+				// only the primary artifact (the first export) is booted;
+				// the others, if any, are just additional artifacts from
+				// the same manifest.
+				var bootCfg *boot.Config
+				if i == 0 {
+					bootCfg = testcase.Boot
+				}
+				testImage(t, s.imageInfo, bootCfg, imagePath, er)
+			}
+		})
+
+		if er != nil {
+			c.Exports = append(c.Exports, *er)
+		}
 	}
 }
 
@@ -246,8 +776,43 @@ func currentArch() string {
 	}
 }
 
-// runTests opens, parses and runs all the specified testcases
-func runTests(t *testing.T, cases []string) {
+// runCase opens, parses and runs the single testcase at p against every
+// backend in backends.
+func runCase(t *testing.T, p, store string, backends []backend) {
+	t.Run(path.Base(p), func(t *testing.T) {
+		f, err := os.Open(p)
+		if err != nil {
+			t.Skipf("%s: cannot open test case: %v", p, err)
+		}
+
+		var testcase testcaseStruct
+		err = json.NewDecoder(f).Decode(&testcase)
+		require.NoErrorf(t, err, "%s: cannot decode test case", p)
+
+		currentArch := currentArch()
+		if testcase.ComposeRequest.Arch != currentArch {
+			t.Skipf("the required arch is %s, the current arch is %s", testcase.ComposeRequest.Arch, currentArch)
+		}
+
+		for _, b := range backends {
+			b := b
+			t.Run(string(b), func(t *testing.T) {
+				runTestcase(t, testcase, store, fmt.Sprintf("%s/%s", path.Base(p), b), b)
+			})
+		}
+	})
+}
+
+// runTests opens, parses and runs all the specified testcases, dispatching
+// each one to every backend given in backends. Up to workerCount cases run
+// at once, via a pool of goroutines each calling t.Run in turn; the
+// testing package explicitly supports Run being called concurrently from
+// multiple goroutines as long as they all finish before the parent test
+// returns, which the WaitGroup below guarantees. This, rather than
+// t.Parallel()/-test.parallel, is what actually bounds concurrency: the
+// latter is fixed by testing.Main before TestImages ever runs, so flipping
+// it afterwards has no effect.
+func runTests(t *testing.T, cases []string, backends []backend) {
 	_ = os.Mkdir("/var/lib/osbuild-tests", 0755)
 	store, err := ioutil.TempDir("/var/lib/osbuild-tests", "osbuild-image-tests-*")
 	require.NoError(t, err, "error creating temporary store")
@@ -257,26 +822,28 @@ func runTests(t *testing.T, cases []string) {
 		require.NoError(t, err, "error removing temporary store")
 	}()
 
-	for _, p := range cases {
-		t.Run(path.Base(p), func(t *testing.T) {
-			f, err := os.Open(p)
-			if err != nil {
-				t.Skipf("%s: cannot open test case: %v", p, err)
-			}
-
-			var testcase testcaseStruct
-			err = json.NewDecoder(f).Decode(&testcase)
-			require.NoErrorf(t, err, "%s: cannot decode test case", p)
+	n := workerCount
+	if n < 1 {
+		n = 1
+	}
 
-			currentArch := currentArch()
-			if testcase.ComposeRequest.Arch != currentArch {
-				t.Skipf("the required arch is %s, the current arch is %s", testcase.ComposeRequest.Arch, currentArch)
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range jobs {
+				runCase(t, p, store, backends)
 			}
+		}()
+	}
 
-			runTestcase(t, testcase, store)
-		})
-
+	for _, p := range cases {
+		jobs <- p
 	}
+	close(jobs)
+	wg.Wait()
 }
 
 func TestImages(t *testing.T) {
@@ -288,5 +855,18 @@ func TestImages(t *testing.T) {
 		require.NoError(t, err)
 	}
 
-	runTests(t, cases)
+	cases, err := filterCases(cases, includePattern, excludePattern)
+	require.NoError(t, err)
+
+	backends, err := parseBackends(backendsFlag)
+	require.NoError(t, err)
+
+	if reportPath != "" {
+		testReport = report.New()
+		defer func() {
+			require.NoError(t, testReport.WriteFile(reportPath))
+		}()
+	}
+
+	runTests(t, cases, backends)
 }
@@ -0,0 +1,128 @@
+// Package report builds the machine-readable JSON report written by
+// osbuild-image-tests when run with -report, so that a CI failure can be
+// triaged without staring at an assert.Equal dump of two enormous trees.
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Diff describes a single leaf mismatch between the expected and the
+// actual image-info report, expressed as a JSONPath-like path into the
+// decoded trees.
+type Diff struct {
+	Path     string      `json:"path"`
+	Expected interface{} `json:"expected"`
+	Got      interface{} `json:"got"`
+}
+
+// ExportResult is the report for a single export (artifact) a testcase
+// produced: its image-info diff and/or boot outcome, whichever of those
+// applies to it.
+type ExportResult struct {
+	Pipeline      string `json:"pipeline"`
+	ImageInfoDiff []Diff `json:"image_info_diff,omitempty"`
+	BootOutcome   string `json:"boot_outcome,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// Case is the report for a single testcase run.
+type Case struct {
+	Name              string                   `json:"name"`
+	ManifestVersion   string                   `json:"manifest_version"`
+	ExportedPipelines []string                 `json:"exported_pipelines"`
+	Duration          time.Duration            `json:"duration_ns"`
+	PipelineDurations map[string]time.Duration `json:"pipeline_durations_ns,omitempty"`
+	Exports           []ExportResult           `json:"exports,omitempty"`
+	Error             string                   `json:"error,omitempty"`
+}
+
+// Report collects the Case reports produced by a single run of
+// TestImages. It is safe for concurrent use, since testcases can run
+// concurrently from several goroutines.
+type Report struct {
+	mu    sync.Mutex
+	Cases []*Case `json:"cases"`
+}
+
+// New returns an empty Report.
+func New() *Report {
+	return &Report{}
+}
+
+// Add appends c to the report.
+func (r *Report) Add(c *Case) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Cases = append(r.Cases, c)
+}
+
+// WriteFile writes the report as indented JSON to path.
+func (r *Report) WriteFile(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot marshal report: %v", err)
+	}
+
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("cannot write report to %s: %v", path, err)
+	}
+	return nil
+}
+
+// DiffImageInfo walks the expected and the actual decoded image-info trees
+// in lock-step and returns the list of leaf mismatches. Keys only present
+// on one side are reported with the missing side set to nil.
+func DiffImageInfo(expected, got interface{}) []Diff {
+	var diffs []Diff
+	walkDiff("$", expected, got, &diffs)
+	return diffs
+}
+
+func walkDiff(path string, expected, got interface{}, diffs *[]Diff) {
+	if expectedMap, ok := expected.(map[string]interface{}); ok {
+		gotMap, _ := got.(map[string]interface{})
+		keys := make(map[string]struct{}, len(expectedMap))
+		for k := range expectedMap {
+			keys[k] = struct{}{}
+		}
+		for k := range gotMap {
+			keys[k] = struct{}{}
+		}
+		for k := range keys {
+			walkDiff(fmt.Sprintf("%s.%s", path, k), expectedMap[k], gotMap[k], diffs)
+		}
+		return
+	}
+
+	if expectedSlice, ok := expected.([]interface{}); ok {
+		gotSlice, _ := got.([]interface{})
+		n := len(expectedSlice)
+		if len(gotSlice) > n {
+			n = len(gotSlice)
+		}
+		for i := 0; i < n; i++ {
+			var e, g interface{}
+			if i < len(expectedSlice) {
+				e = expectedSlice[i]
+			}
+			if i < len(gotSlice) {
+				g = gotSlice[i]
+			}
+			walkDiff(fmt.Sprintf("%s[%d]", path, i), e, g, diffs)
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(expected, got) {
+		*diffs = append(*diffs, Diff{Path: path, Expected: expected, Got: got})
+	}
+}
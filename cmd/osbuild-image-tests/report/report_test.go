@@ -0,0 +1,52 @@
+package report
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffImageInfoEqual(t *testing.T) {
+	tree := map[string]interface{}{
+		"packages": []interface{}{"a", "b"},
+		"rpm":      map[string]interface{}{"name": "bash"},
+	}
+
+	diffs := DiffImageInfo(tree, tree)
+	assert.Empty(t, diffs)
+}
+
+func TestDiffImageInfoMismatch(t *testing.T) {
+	expected := map[string]interface{}{
+		"packages": []interface{}{"a", "b"},
+		"rpm":      map[string]interface{}{"name": "bash"},
+	}
+	got := map[string]interface{}{
+		"packages": []interface{}{"a", "c"},
+		"rpm":      map[string]interface{}{"name": "dash"},
+	}
+
+	diffs := DiffImageInfo(expected, got)
+	assert.ElementsMatch(t, []Diff{
+		{Path: "$.packages[1]", Expected: "b", Got: "c"},
+		{Path: "$.rpm.name", Expected: "bash", Got: "dash"},
+	}, diffs)
+}
+
+func TestDiffImageInfoMissingKeysAndExtraElements(t *testing.T) {
+	expected := map[string]interface{}{
+		"packages":         []interface{}{"a"},
+		"only_in_expected": "x",
+	}
+	got := map[string]interface{}{
+		"packages":    []interface{}{"a", "b"},
+		"only_in_got": "y",
+	}
+
+	diffs := DiffImageInfo(expected, got)
+	assert.ElementsMatch(t, []Diff{
+		{Path: "$.packages[1]", Expected: nil, Got: "b"},
+		{Path: "$.only_in_expected", Expected: "x", Got: nil},
+		{Path: "$.only_in_got", Expected: nil, Got: "y"},
+	}, diffs)
+}